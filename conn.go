@@ -3,8 +3,9 @@ package conn
 import (
 	"context"
 	"errors"
-	"io"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -12,131 +13,457 @@ var (
 	InvalidConfig = errors.New("invalid config")
 )
 
-type builder func() (*Poolable, error)
+// builder 构造一个由用户管理的资源，类型可以是 *sql.Conn、grpc.ClientConn
+// 或任意自定义的连接句柄，池本身不对其做任何假设。
+type builder func() (interface{}, error)
 
+// build 调用用户提供的 builder 构造资源，包一层 Poolable 并打上
+// createdAt/lastUsedAt 时间戳；如果配置了 contextFn，还会用它给这个资源
+// 挂上一个元数据 context，供 Context() 取用。
+func (conn *Conn) build() (*Poolable, error) {
+	value, err := conn.builder()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	p := &Poolable{Value: value, createdAt: now, lastUsedAt: now}
+	if conn.contextFn != nil {
+		p.ctx = conn.contextFn(value)
+	}
+	return p, nil
+}
+
+// Poolable 包装池管理的一个资源。Value 是用户通过 builder 构造的实际
+// 资源，其生命周期由用户提供的 Close/Ping 回调管理，池本身不关心其类型。
 type Poolable struct {
-	Conn io.Closer
-	context.Context
+	Value interface{}
+	ctx   context.Context // 可选的元数据，由 Options.Context 提供，默认为 context.Background()
+
+	createdAt  time.Time // 连接建立时间，用于 MaxLifetime 判断
+	lastUsedAt time.Time // 最近一次被归还的时间，用于 MaxIdleTime 判断
+}
+
+// Context 返回挂在这个资源上的元数据 context，未通过 Options.Context 设置
+// 时返回 context.Background()。AcquireContext 用它提前感知资源已失效
+// （比如底层连接绑定的 context 被取消），从而在归还前就把它淘汰重建。
+func (p *Poolable) Context() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+// waiter 是一个排队等待连接的请求。abandoned 由 conn.mutex 保护，用于
+// Close 在持锁窗口之外重建连接时判断这个等待者是否已经因 ctx 取消而
+// 不会再有人来读 ch 了。
+type waiter struct {
+	ch        chan *Poolable
+	abandoned bool
 }
 
 type Conn struct {
-	notice  chan struct{}  // 关闭信号
-	pool    chan *Poolable // 可关闭连接池
-	max     int            // 池容量
-	active  int            // 可用的连接数
-	closed  bool           // 池是否已关闭
-	builder builder        // 构造连接
+	pool    chan *Poolable          // 空闲连接队列
+	waiters []*waiter               // 等待连接的 FIFO 队列，由 mutex 保护
+	minOpen int                     // 常驻的最小连接数，空闲收割不会低于此值
+	maxOpen int                     // 池最大容量，按需惰性扩容到此值
+	active  int                     // 当前已建立的连接数（含空闲和已借出）
+	closed  bool                    // 池是否已关闭
+	builder builder                 // 构造连接
+	closeFn func(interface{}) error // 关闭连接，必填
 	mutex   *sync.Mutex
+
+	ping              func(interface{}) error           // 健康检查回调，为 nil 时不做检查
+	contextFn         func(interface{}) context.Context // 元数据 context 回调，为 nil 时 Context() 返回 context.Background()
+	idleCheckInterval time.Duration                     // 空闲连接巡检周期，<=0 时不启动巡检
+	stopIdleCheck     chan struct{}
+
+	maxLifetime time.Duration // 连接自创建起的最长存活时间，<=0 表示不限制
+	maxIdleTime time.Duration // 连接自上次归还起的最长空闲时间，<=0 表示不限制
+
+	waitCount    int64 // 累计因池饱和而等待的次数，原子操作
+	waitDuration int64 // 累计等待耗时（纳秒），原子操作
 }
 
-// 获取连接
-func (conn *Conn) Acquire() (*Poolable, error) {
-	if conn.closed {
-		return nil, PoolClosed
+// Stats 是 Stats 方法返回的连接池运行时统计信息。
+type Stats struct {
+	Active       int           // 当前已建立的连接数（含空闲和已借出）
+	Idle         int           // 当前空闲队列中的连接数
+	WaitCount    int64         // 累计因池饱和而等待的次数
+	WaitDuration time.Duration // 累计等待耗时
+}
+
+// recordWait 记录一次因池饱和而产生的等待，用于 Stats。
+func (conn *Conn) recordWait(start time.Time) {
+	atomic.AddInt64(&conn.waitCount, 1)
+	atomic.AddInt64(&conn.waitDuration, int64(time.Since(start)))
+}
+
+// Stats 返回连接池当前的运行时统计信息。
+func (conn *Conn) Stats() Stats {
+	conn.mutex.Lock()
+	active := conn.active
+	conn.mutex.Unlock()
+	return Stats{
+		Active:       active,
+		Idle:         len(conn.pool),
+		WaitCount:    atomic.LoadInt64(&conn.waitCount),
+		WaitDuration: time.Duration(atomic.LoadInt64(&conn.waitDuration)),
 	}
+}
+
+// 获取连接，不支持取消或超时，等价于 AcquireContext(context.Background())
+func (conn *Conn) Acquire() (*Poolable, error) {
+	return conn.AcquireContext(context.Background())
+}
+
+// AcquireContext 获取连接，池饱和时会阻塞等待，直至有连接归还、ctx 被取消
+// 或超时。ctx 被取消时返回 ctx.Err()；池被 Release 后返回 PoolClosed。
+func (conn *Conn) AcquireContext(ctx context.Context) (*Poolable, error) {
 	for {
-		closer, err := conn.acquire()
+		closer, err := conn.acquire(ctx)
 		if err != nil {
 			return nil, err
 		}
 		select {
-		case <-closer.Done():
+		case <-closer.Context().Done():
 			conn.Close(closer)
 			continue
 		default:
-			return closer, nil
 		}
+		if conn.expired(closer) {
+			conn.Close(closer)
+			continue
+		}
+		if conn.ping != nil {
+			if err := conn.ping(closer.Value); err != nil {
+				conn.Close(closer)
+				continue
+			}
+		}
+		return closer, nil
+	}
+}
+
+// expired 判断连接是否已超过 MaxLifetime 或 MaxIdleTime，需要被回收重建。
+func (conn *Conn) expired(closer *Poolable) bool {
+	now := time.Now()
+	if conn.maxLifetime > 0 && now.Sub(closer.createdAt) > conn.maxLifetime {
+		return true
 	}
+	if conn.maxIdleTime > 0 && now.Sub(closer.lastUsedAt) > conn.maxIdleTime {
+		return true
+	}
+	return false
 }
 
-func (conn *Conn) acquire() (*Poolable, error) {
-acquire:
+// acquire 在持锁期间决定如何满足这次请求：直接从空闲队列取、按需建一个
+// 新连接，或者注册为等待者排队。排队的等待者由 Regain/Close 按 FIFO
+// 顺序唤醒，而不是依赖一个粗糙的全局"有连接被释放了"信号。
+func (conn *Conn) acquire(ctx context.Context) (*Poolable, error) {
+	conn.mutex.Lock()
+	if conn.closed {
+		conn.mutex.Unlock()
+		return nil, PoolClosed
+	}
 	select {
 	case closer := <-conn.pool:
+		conn.mutex.Unlock()
 		return closer, nil
 	default:
-		conn.mutex.Lock()
-		if conn.active >= conn.max {
-			conn.mutex.Unlock()
-			select {
-			case closer := <-conn.pool:
-				return closer, nil
-			case <-conn.notice:
-				goto acquire
-			}
-		}
-		closer, err := conn.builder()
+	}
+	// 只有在没有人排队等待时才允许走快速建连路径：否则一个刚好在这时
+	// 到达的新请求会插到已排队等待者前面，破坏 FIFO 顺序。
+	if conn.active < conn.maxOpen && len(conn.waiters) == 0 {
+		closer, err := conn.build()
 		if err != nil {
 			conn.mutex.Unlock()
 			return nil, err
 		}
 		conn.active++
-		conn.pool <- closer
 		conn.mutex.Unlock()
-		return <-conn.pool, nil
+		return closer, nil
+	}
+	w := &waiter{ch: make(chan *Poolable, 1)}
+	conn.waiters = append(conn.waiters, w)
+	conn.mutex.Unlock()
+
+	start := time.Now()
+	select {
+	case closer, ok := <-w.ch:
+		conn.recordWait(start)
+		if !ok {
+			return nil, PoolClosed
+		}
+		return closer, nil
+	case <-ctx.Done():
+		conn.recordWait(start)
+		conn.abandonWaiter(w)
+		return nil, ctx.Err()
+	}
+}
+
+// abandonWaiter 处理一个因 ctx 取消而不再等待的 waiter。如果它还在队列里，
+// 直接移除即可。如果已经不在队列里，说明 Regain/Close 正在或已经处理它：
+//   - Regain 的出队和发送在同一次持锁区间内完成，此时 w.ch 要么已经收到
+//     连接，要么压根不会再收到，直接非阻塞读一次即可知道结果；
+//   - Close 的出队和发送之间隔着一次不持锁的 build()，此时 w.ch 可能还没
+//     收到连接——这种情况下把 w 标记为 abandoned，让 Close 在 build 完成
+//     后自己发现并把连接转交给别人，而不是发到一个再也没人读的 channel。
+//
+// 不论哪种情况，只要连接已经躺在 w.ch 里，就把它转交给下一个等待者或放
+// 回空闲队列，避免被无声丢弃。
+func (conn *Conn) abandonWaiter(w *waiter) {
+	conn.mutex.Lock()
+	for i, x := range conn.waiters {
+		if x == w {
+			conn.waiters = append(conn.waiters[:i], conn.waiters[i+1:]...)
+			conn.mutex.Unlock()
+			return
+		}
+	}
+	w.abandoned = true
+	conn.mutex.Unlock()
+	select {
+	case closer, ok := <-w.ch:
+		if ok {
+			conn.Regain(closer)
+		}
+	default:
 	}
 }
 
 // 回收连接
+//
+// 如果有等待者排队，连接直接交给队首的等待者；否则，当池中空闲连接数已
+// 达到 minOpen 时，多余的连接会被直接关闭而不是放回空闲队列，以便池可以
+// 向 minOpen 收缩，否则连接被放回队列供下次复用。
+//
+// 出队等待者和把连接交给它这两步必须在同一次持锁期间完成：如果中间释放
+// 锁，等待者的 ctx 可能恰好在这个窗口里取消，abandonWaiter 既找不到它
+// （已经出队）也读不到即将到达的连接（还没发送），连接就会永久卡在一个
+// 再也没人读的 channel 里。
 func (conn *Conn) Regain(closer *Poolable) error {
+	closer.lastUsedAt = time.Now()
+	conn.mutex.Lock()
 	if conn.closed {
+		conn.mutex.Unlock()
 		return PoolClosed
 	}
+	if len(conn.waiters) > 0 {
+		w := conn.waiters[0]
+		conn.waiters = conn.waiters[1:]
+		w.ch <- closer // 带缓冲 channel，持锁发送不会阻塞
+		conn.mutex.Unlock()
+		return nil
+	}
+	if conn.active > conn.minOpen && len(conn.pool) >= conn.minOpen {
+		conn.mutex.Unlock()
+		return conn.Close(closer)
+	}
 	conn.pool <- closer
+	conn.mutex.Unlock()
 	return nil
 }
 
-// 关闭连接
+// 关闭连接。无论 closeFn 是否返回错误都会释放 mutex 并扣减 active。
+//
+// 腾出的名额若有等待者排队，会立刻为其建一个新连接。出队等待者时先把
+// active 加回去，为它预占这个名额，避免期间赶到的新 Acquire 在 acquire()
+// 里看到 active < maxOpen 就抢先建连、插队到这个等待者前面；如果重建
+// 失败，再把名额还回去并把等待者塞回队首，保持 FIFO 顺序。
+//
+// build() 本身不持锁（可能很慢），所以出队和最终交付连接这两步隔着一个
+// 窗口，和 Regain 不一样不能简单地在同一次持锁区间内完成。如果等待者在
+// 这个窗口里因 ctx 取消被 abandonWaiter 标记为 abandoned，这里在重新持锁
+// 后会发现这个标记，转而把建好的连接通过 Regain 交给下一个等待者或放回
+// 空闲队列，而不是发到一个再也没人读的 channel 里。
+//
+// 同样地，Release() 也可能在这个窗口里运行：w 在出队时就已经离开了
+// conn.waiters，Release() 捕获等待者列表时看不到它，自然也不会替我们关闭
+// w.ch。所以重新持锁后要再检查一次 conn.closed，自己收尾——建好的连接
+// （如果有）直接关闭掉，再关闭 w.ch 让阻塞的调用者（包括没有 ctx 可以
+// 取消的 Acquire()）收到 PoolClosed 而不是永远卡住。
 func (conn *Conn) Close(closer *Poolable) error {
 	conn.mutex.Lock()
-	err := closer.Conn.Close()
-	if err != nil {
+	err := conn.closeFn(closer.Value)
+	conn.active--
+	var w *waiter
+	if len(conn.waiters) > 0 && conn.active < conn.maxOpen {
+		w = conn.waiters[0]
+		conn.waiters = conn.waiters[1:]
+		conn.active++ // 为这个等待者预占名额，重建期间不让新 Acquire 抢占
+	}
+	conn.mutex.Unlock()
+	if w == nil {
 		return err
 	}
-	conn.active--
-	if len(conn.notice) == 0 {
-		conn.notice <- struct{}{}
+	fresh, buildErr := conn.build()
+	conn.mutex.Lock()
+	if conn.closed {
+		conn.active--
+		conn.mutex.Unlock()
+		if buildErr == nil {
+			conn.closeFn(fresh.Value)
+		}
+		close(w.ch)
+		return err
+	}
+	if buildErr != nil {
+		// 这次建连失败，归还预占的名额。等待者如果还没被放弃，塞回队首
+		// 保持 FIFO；如果已经放弃，就没有必要再排回去了。
+		conn.active--
+		if !w.abandoned {
+			conn.waiters = append([]*waiter{w}, conn.waiters...)
+		}
+		conn.mutex.Unlock()
+		return err
+	}
+	if w.abandoned {
+		// 等待者已经不会再来读了，把建好的连接转交给下一个等待者或放回
+		// 空闲队列，避免白白建了一个连接却无人认领。
+		conn.mutex.Unlock()
+		conn.Regain(fresh)
+		return err
 	}
+	w.ch <- fresh // 带缓冲 channel，持锁发送不会阻塞
 	conn.mutex.Unlock()
-	return nil
+	return err
 }
 
-// 关闭连接池
+// 关闭连接池。可以安全地与正在进行的 Acquire/AcquireContext/Regain 并发
+// 调用：排队中的等待者会被唤醒并收到 PoolClosed。
+//
+// conn.pool 本身永远不会被 close：它被多个 goroutine（Regain、
+// idleEvictor）并发写入，而 Go 的 channel 不允许向已关闭的 channel 发送，
+// 否则会 panic。所有入队操作都先在持有 mutex 时检查 conn.closed，
+// 因此这里只需在持锁状态下把已缓冲的空闲连接非阻塞地排空即可。
 func (conn *Conn) Release() error {
+	conn.mutex.Lock()
 	if conn.closed {
+		conn.mutex.Unlock()
 		return PoolClosed
 	}
-	conn.mutex.Lock()
-	close(conn.pool)
-	for closer := range conn.pool {
-		conn.active--
-		closer.Conn.Close()
-	}
 	conn.closed = true
+	if conn.stopIdleCheck != nil {
+		close(conn.stopIdleCheck)
+	}
+	waiters := conn.waiters
+	conn.waiters = nil
+drain:
+	for {
+		select {
+		case closer := <-conn.pool:
+			conn.active--
+			conn.closeFn(closer.Value)
+		default:
+			break drain
+		}
+	}
 	conn.mutex.Unlock()
+
+	for _, w := range waiters {
+		close(w.ch)
+	}
 	return nil
 }
 
-// 创建连接管理器
-func NewManager(max int, builder builder) (*Conn, error) {
-	if max <= 0 {
+// idleEvictor 周期性地巡检空闲连接：剔除健康检查失败的连接，并在空闲
+// 连接数超过 minOpen 时收割多余的连接，使池向 minOpen 收缩。
+//
+// 把 conn.closed 的检查和放回 conn.pool 的动作放进同一段持锁区间，使其
+// 与 Release 的关闭互斥：要么这次放回发生在 Release 排空之前（会被正常
+// 排空关闭），要么发生在 Release 已经把 closed 置位之后（转而直接关闭），
+// 不会出现放回一个此后再也没人读取的幽灵连接。
+func (conn *Conn) idleEvictor() {
+	ticker := time.NewTicker(conn.idleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.stopIdleCheck:
+			return
+		case <-ticker.C:
+			n := len(conn.pool)
+			for i := 0; i < n; i++ {
+				select {
+				case closer := <-conn.pool:
+					if conn.ping != nil && conn.ping(closer.Value) != nil {
+						conn.Close(closer)
+						continue
+					}
+					conn.mutex.Lock()
+					if conn.closed {
+						conn.mutex.Unlock()
+						conn.Close(closer)
+						continue
+					}
+					if conn.active > conn.minOpen && len(conn.pool) >= conn.minOpen {
+						conn.mutex.Unlock()
+						conn.Close(closer)
+						continue
+					}
+					conn.pool <- closer
+					conn.mutex.Unlock()
+				default:
+				}
+			}
+		}
+	}
+}
+
+// Options 描述连接管理器的可选行为，随着池的能力增加而增加字段，
+// 避免 NewManagerWithOptions 的参数列表无限增长。
+type Options struct {
+	InitialCap int // 启动时预建立的连接数，默认等于 MinOpen
+	MinOpen    int // 常驻的最小连接数，空闲收割不会低于此值
+	MaxOpen    int // 池最大容量，按需惰性扩容到此值
+
+	Close   func(interface{}) error           // 关闭资源的回调，必填
+	Ping    func(interface{}) error           // 健康检查回调，为 nil 时不做检查
+	Context func(interface{}) context.Context // 元数据 context 回调，为 nil 时 Poolable.Context() 返回 context.Background()
+
+	IdleCheckInterval time.Duration // 空闲连接巡检周期，<=0 时不启动巡检
+
+	MaxLifetime time.Duration // 连接自创建起的最长存活时间，<=0 表示不限制
+	MaxIdleTime time.Duration // 连接自上次归还起的最长空闲时间，<=0 表示不限制
+}
+
+// 创建连接管理器，池容量固定为 max，启动时即建好全部连接。builder 构造
+// 资源，closeFn 负责关闭它——两者都必填，类型由调用方自行决定。
+func NewManager(max int, builder builder, closeFn func(interface{}) error) (*Conn, error) {
+	return NewManagerWithOptions(Options{InitialCap: max, MinOpen: max, MaxOpen: max, Close: closeFn}, builder)
+}
+
+// NewManagerWithOptions 按 Options 创建连接管理器：启动时建立
+// InitialCap 个连接，按需惰性扩容到 MaxOpen，空闲收割不会低于 MinOpen。
+func NewManagerWithOptions(opts Options, builder builder) (*Conn, error) {
+	if opts.MaxOpen <= 0 || opts.MinOpen < 0 || opts.InitialCap < 0 || opts.MinOpen > opts.MaxOpen || opts.InitialCap > opts.MaxOpen || opts.Close == nil {
 		return nil, InvalidConfig
 	}
 	conn := &Conn{
-		notice:  make(chan struct{}, max),
-		max:     max,
-		pool:    make(chan *Poolable, max),
-		closed:  false,
-		builder: builder,
-		mutex:   new(sync.Mutex),
-	}
-	for i := 0; i < max; i++ {
-		closer, err := builder()
+		minOpen:           opts.MinOpen,
+		maxOpen:           opts.MaxOpen,
+		pool:              make(chan *Poolable, opts.MaxOpen),
+		closed:            false,
+		builder:           builder,
+		closeFn:           opts.Close,
+		mutex:             new(sync.Mutex),
+		ping:              opts.Ping,
+		contextFn:         opts.Context,
+		idleCheckInterval: opts.IdleCheckInterval,
+		maxLifetime:       opts.MaxLifetime,
+		maxIdleTime:       opts.MaxIdleTime,
+	}
+	for i := 0; i < opts.InitialCap; i++ {
+		closer, err := conn.build()
 		if err != nil {
 			return nil, err
 		}
 		conn.active++
 		conn.pool <- closer
 	}
+	if opts.IdleCheckInterval > 0 {
+		conn.stopIdleCheck = make(chan struct{})
+		go conn.idleEvictor()
+	}
 	return conn, nil
 }
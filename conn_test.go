@@ -0,0 +1,198 @@
+package conn
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestReleaseDuringIdleEviction guards against the idleEvictor panic fixed
+// in chunk0-6: a tick racing Release() used to receive a nil *Poolable off
+// a closed conn.pool and then dereference or write to it. Run with
+// -race to catch the underlying data race too.
+func TestReleaseDuringIdleEviction(t *testing.T) {
+	var built int64
+	builder := func() (interface{}, error) {
+		return atomic.AddInt64(&built, 1), nil
+	}
+	closeFn := func(interface{}) error { return nil }
+	ping := func(interface{}) error {
+		time.Sleep(5 * time.Millisecond) // simulate a real network-calling ping
+		return nil
+	}
+
+	c, err := NewManagerWithOptions(Options{
+		InitialCap:        4,
+		MinOpen:           4,
+		MaxOpen:           4,
+		Close:             closeFn,
+		Ping:              ping,
+		IdleCheckInterval: time.Millisecond,
+	}, builder)
+	if err != nil {
+		t.Fatalf("NewManagerWithOptions: %v", err)
+	}
+
+	time.Sleep(3 * time.Millisecond) // let idleEvictor start a cycle
+	if err := c.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond) // give any in-flight cycle a chance to misbehave
+}
+
+// TestAcquireContextCancelDuringHandoff guards against the waiter-leak fixed
+// in chunk0-6: cancelling a waiter's ctx while Close() is rebuilding its
+// replacement used to leave the fresh connection stranded in a channel
+// nobody would ever read again. Run with -race to catch the underlying
+// data race too.
+func TestAcquireContextCancelDuringHandoff(t *testing.T) {
+	var buildCount int64
+	gate := make(chan struct{})
+	builder := func() (interface{}, error) {
+		if atomic.AddInt64(&buildCount, 1) == 2 {
+			<-gate // block only the rebuild triggered by Close, below
+		}
+		return struct{}{}, nil
+	}
+	closeFn := func(interface{}) error { return nil }
+
+	c, err := NewManagerWithOptions(Options{
+		InitialCap: 1, MinOpen: 1, MaxOpen: 1, Close: closeFn,
+	}, builder)
+	if err != nil {
+		t.Fatalf("NewManagerWithOptions: %v", err)
+	}
+
+	first, err := c.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiterDone := make(chan error, 1)
+	go func() {
+		_, err := c.AcquireContext(ctx)
+		waiterDone <- err
+	}()
+	time.Sleep(10 * time.Millisecond) // let it register as a waiter
+
+	go c.Close(first)                 // dequeues the waiter and starts rebuilding its replacement
+	time.Sleep(10 * time.Millisecond) // let Close reach the blocked rebuild
+
+	cancel()
+	if err := <-waiterDone; err != context.Canceled {
+		t.Fatalf("AcquireContext error = %v, want context.Canceled", err)
+	}
+
+	close(gate) // let the rebuild finish and hand off to the now-abandoned waiter
+	time.Sleep(10 * time.Millisecond)
+
+	stats := c.Stats()
+	if stats.Active != 1 || stats.Idle != 1 {
+		t.Fatalf("Stats() = %+v, want the reclaimed connection back in the idle queue", stats)
+	}
+}
+
+// TestCloseRebuildFailsDuringRelease guards against the hang fixed in
+// chunk0-6: Close() dequeues a waiter before rebuilding its replacement, so
+// if Release() runs in that window it never sees the waiter and won't close
+// its channel. If the rebuild then failed, Close() used to unconditionally
+// re-queue the waiter onto a pool that is already shut down, leaving it
+// blocked forever — including plain Acquire(), which has no ctx to fall
+// back on. Run with -race to catch the underlying data race too.
+func TestCloseRebuildFailsDuringRelease(t *testing.T) {
+	var buildCount int64
+	gate := make(chan struct{})
+	boom := errors.New("boom")
+	builder := func() (interface{}, error) {
+		if atomic.AddInt64(&buildCount, 1) == 2 {
+			<-gate // block only the rebuild triggered by Close, below
+			return nil, boom
+		}
+		return struct{}{}, nil
+	}
+	closeFn := func(interface{}) error { return nil }
+
+	c, err := NewManagerWithOptions(Options{
+		InitialCap: 1, MinOpen: 1, MaxOpen: 1, Close: closeFn,
+	}, builder)
+	if err != nil {
+		t.Fatalf("NewManagerWithOptions: %v", err)
+	}
+
+	first, err := c.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+
+	waiterDone := make(chan error, 1)
+	go func() {
+		_, err := c.Acquire()
+		waiterDone <- err
+	}()
+	time.Sleep(10 * time.Millisecond) // let it register as a waiter
+
+	go c.Close(first)                 // dequeues the waiter and starts rebuilding its replacement
+	time.Sleep(10 * time.Millisecond) // let Close reach the blocked rebuild
+
+	if err := c.Release(); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+
+	close(gate) // let the rebuild fail now that the pool is already closed
+
+	select {
+	case err := <-waiterDone:
+		if err != PoolClosed {
+			t.Fatalf("Acquire() error = %v, want PoolClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waiter never woke up after Release() closed the pool mid-rebuild")
+	}
+}
+
+// TestOptionsContextEarlyEviction guards against the chunk0-5 regression
+// where Poolable.ctx had no way to ever be populated: Context() always
+// returned context.Background() and the early-expiry check in
+// AcquireContext was dead code. Options.Context restores the hook.
+func TestOptionsContextEarlyEviction(t *testing.T) {
+	staleCtx, cancel := context.WithCancel(context.Background())
+	cancel() // already cancelled: the very first connection built is stale
+	var built, closed int64
+	builder := func() (interface{}, error) {
+		return atomic.AddInt64(&built, 1), nil
+	}
+	closeFn := func(interface{}) error {
+		atomic.AddInt64(&closed, 1)
+		return nil
+	}
+
+	c, err := NewManagerWithOptions(Options{
+		InitialCap: 1, MinOpen: 1, MaxOpen: 1, Close: closeFn,
+		Context: func(interface{}) context.Context {
+			if atomic.LoadInt64(&built) <= 1 {
+				return staleCtx
+			}
+			return context.Background()
+		},
+	}, builder)
+	if err != nil {
+		t.Fatalf("NewManagerWithOptions: %v", err)
+	}
+
+	closer, err := c.Acquire()
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if got := atomic.LoadInt64(&built); got != 2 {
+		t.Fatalf("built = %d, want 2 (the stale connection discarded, a fresh one built)", got)
+	}
+	if got := atomic.LoadInt64(&closed); got != 1 {
+		t.Fatalf("closed = %d, want 1 (the stale connection closed before handing out the fresh one)", got)
+	}
+	if closer.Context() == staleCtx {
+		t.Fatalf("Acquire() returned the stale connection instead of discarding it")
+	}
+}